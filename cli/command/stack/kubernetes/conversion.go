@@ -0,0 +1,300 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/compose-on-kubernetes/api/labels"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// convertToServices converts a combination of Kubernetes ReplicaSets (for
+// stack services in replicated mode) and DaemonSets (for stack services in
+// global mode), together with the Kubernetes Services that expose them, into
+// the equivalent list of swarm.Service objects expected by `docker stack
+// services` and `docker stack ps`, honouring the same `--filter` syntax as
+// the Swarm backend (name, id, label and mode).
+func convertToServices(replicas *appsv1beta2.ReplicaSetList, daemonSets *appsv1beta2.DaemonSetList, services *apiv1.ServiceList, filter filters.Args) ([]swarm.Service, error) {
+	var swarmServices []swarm.Service
+	if matchesMode(filter, "replicated") {
+		replicatedServices, err := replicasToServices(replicas, services)
+		if err != nil {
+			return nil, err
+		}
+		swarmServices = append(swarmServices, replicatedServices...)
+	}
+	if matchesMode(filter, "global") {
+		globalServices, err := daemonSetsToServices(daemonSets, services)
+		if err != nil {
+			return nil, err
+		}
+		swarmServices = append(swarmServices, globalServices...)
+	}
+	return filterServices(swarmServices, services, filter), nil
+}
+
+// matchesMode reports whether filter allows services in the given mode
+// ("replicated" or "global") to be considered at all, so that the caller can
+// skip listing ReplicaSets or DaemonSets it already knows will be filtered
+// out.
+func matchesMode(filter filters.Args, mode string) bool {
+	return !filter.Contains("mode") || filter.ExactMatch("mode", mode)
+}
+
+// filterServices applies the name, id and label filters against the already
+// converted swarm.Service list. Mode is handled earlier, by matchesMode, so
+// that unwanted ReplicaSets/DaemonSets are never even converted.
+func filterServices(swarmServices []swarm.Service, services *apiv1.ServiceList, filter filters.Args) []swarm.Service {
+	if filter.Len() == 0 {
+		return swarmServices
+	}
+	filtered := make([]swarm.Service, 0, len(swarmServices))
+	for _, swarmService := range swarmServices {
+		kubeService := findServiceByUID(swarmService.ID, services)
+		if !filter.Match("id", swarmService.ID) {
+			continue
+		}
+		if !matchesName(filter, swarmService) {
+			continue
+		}
+		if kubeService != nil && !filter.MatchKVList("label", kubeService.Labels) {
+			continue
+		}
+		filtered = append(filtered, swarmService)
+	}
+	return filtered
+}
+
+// matchesName matches both the unprefixed Kubernetes service name and the
+// `stack_name` form Swarm users expect, so `--filter name=` behaves the same
+// regardless of which form the user types.
+func matchesName(filter filters.Args, swarmService swarm.Service) bool {
+	if !filter.Contains("name") {
+		return true
+	}
+	unprefixed := swarmService.Spec.Annotations.Name
+	if idx := strings.IndexByte(unprefixed, '_'); idx >= 0 {
+		unprefixed = unprefixed[idx+1:]
+	}
+	return filter.Match("name", unprefixed) || filter.Match("name", swarmService.Spec.Annotations.Name)
+}
+
+// findServiceByUID finds the Kubernetes Service backing a converted
+// swarm.Service, identified by the UID used as its ID.
+func findServiceByUID(uid string, services *apiv1.ServiceList) *apiv1.Service {
+	for i, service := range services.Items {
+		if string(service.UID) == uid {
+			return &services.Items[i]
+		}
+	}
+	return nil
+}
+
+// replicasToServices converts ReplicaSets (Swarm "replicated" mode services)
+// into swarm.Service objects.
+func replicasToServices(replicas *appsv1beta2.ReplicaSetList, services *apiv1.ServiceList) ([]swarm.Service, error) {
+	var swarmServices []swarm.Service
+	for _, replica := range replicas.Items {
+		headless, err := findHeadlessService(replica.Labels[labels.ForServiceName], services)
+		if err != nil {
+			return nil, err
+		}
+		swarmService := newSwarmService(headless, replica.Spec.Template.Spec.Containers)
+		replicaCount := uint64(replica.Status.Replicas)
+		swarmService.Spec.Mode = swarm.ServiceMode{
+			Replicated: &swarm.ReplicatedService{Replicas: &replicaCount},
+		}
+		swarmService.ServiceStatus = &swarm.ServiceStatus{
+			RunningTasks: uint64(replica.Status.AvailableReplicas),
+			DesiredTasks: uint64(replica.Status.Replicas),
+		}
+		if err := withServicePorts(headless, services, replica.Spec.Template.Spec.Containers, &swarmService); err != nil {
+			return nil, err
+		}
+		swarmServices = append(swarmServices, swarmService)
+	}
+	return swarmServices, nil
+}
+
+// daemonSetsToServices converts DaemonSets (Swarm "global" mode services)
+// into swarm.Service objects.
+func daemonSetsToServices(daemonSets *appsv1beta2.DaemonSetList, services *apiv1.ServiceList) ([]swarm.Service, error) {
+	var swarmServices []swarm.Service
+	for _, daemonSet := range daemonSets.Items {
+		headless, err := findHeadlessService(daemonSet.Labels[labels.ForServiceName], services)
+		if err != nil {
+			return nil, err
+		}
+		swarmService := newSwarmService(headless, daemonSet.Spec.Template.Spec.Containers)
+		swarmService.Spec.Mode = swarm.ServiceMode{
+			Global: &swarm.GlobalService{},
+		}
+		swarmService.ServiceStatus = &swarm.ServiceStatus{
+			RunningTasks: uint64(daemonSet.Status.NumberAvailable),
+			DesiredTasks: uint64(daemonSet.Status.DesiredNumberScheduled),
+		}
+		if err := withServicePorts(headless, services, daemonSet.Spec.Template.Spec.Containers, &swarmService); err != nil {
+			return nil, err
+		}
+		swarmServices = append(swarmServices, swarmService)
+	}
+	return swarmServices, nil
+}
+
+// newSwarmService builds the common shape of a swarm.Service shared by both
+// the replicated and global conversion paths, before mode and status specific
+// fields are filled in by the caller.
+func newSwarmService(headless *apiv1.Service, containers []apiv1.Container) swarm.Service {
+	var image string
+	if len(containers) > 0 {
+		image = containers[0].Image
+	}
+	return swarm.Service{
+		ID: string(headless.UID),
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: fmt.Sprintf("%s_%s", headless.Labels[labels.ForStackName], headless.Name),
+			},
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: &swarm.ContainerSpec{
+					Image: image,
+				},
+			},
+		},
+	}
+}
+
+// findHeadlessService finds the Kubernetes Service that compose-on-kubernetes
+// creates for every stack service, named after it, which carries the stack
+// service's stable identity (UID, stack membership) regardless of whether the
+// service is also published via a LoadBalancer or NodePort Service.
+func findHeadlessService(name string, services *apiv1.ServiceList) (*apiv1.Service, error) {
+	for i, service := range services.Items {
+		if service.Name == name {
+			return &services.Items[i], nil
+		}
+	}
+	return nil, fmt.Errorf("could not find service for %s", name)
+}
+
+// withServicePorts looks for a Service publishing the headless Service's ports (a
+// LoadBalancer or NodePort Service named after it) and, if found, copies its
+// ports and LoadBalancer ingress addresses onto swarmService. containers is
+// the pod template of the ReplicaSet/DaemonSet behind headless, needed to
+// resolve ServicePorts whose TargetPort names a container port rather than
+// giving its number directly.
+func withServicePorts(headless *apiv1.Service, services *apiv1.ServiceList, containers []apiv1.Container, swarmService *swarm.Service) error {
+	for _, service := range services.Items {
+		if !isPublishedCompanion(headless, &service) {
+			continue
+		}
+		publishMode := swarm.PortConfigPublishModeIngress
+		if service.Spec.Type == apiv1.ServiceTypeNodePort {
+			publishMode = swarm.PortConfigPublishModeHost
+		}
+		for _, port := range service.Spec.Ports {
+			target, err := targetPort(port, containers)
+			if err != nil {
+				return err
+			}
+			swarmService.Endpoint.Ports = append(swarmService.Endpoint.Ports, swarm.PortConfig{
+				PublishMode:   publishMode,
+				PublishedPort: uint32(port.Port),
+				TargetPort:    target,
+				Protocol:      protocolFor(port.Protocol),
+			})
+			swarmService.Endpoint.Spec.Ports = append(swarmService.Endpoint.Spec.Ports, specPorts(service.Spec.Type, port, target)...)
+		}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			swarmService.Endpoint.VirtualIPs = append(swarmService.Endpoint.VirtualIPs, swarm.EndpointVirtualIP{
+				Addr: ingressAddr(ingress),
+			})
+		}
+	}
+	return nil
+}
+
+// specPorts builds the desired-state PortConfig entries for a ServicePort: a
+// LoadBalancer ServicePort is reachable both through its ingress port
+// (mode=ingress) and, because Kubernetes always allocates one, through its
+// NodePort (mode=host); a plain NodePort ServicePort only has the latter.
+func specPorts(serviceType apiv1.ServiceType, port apiv1.ServicePort, target uint32) []swarm.PortConfig {
+	var ports []swarm.PortConfig
+	if serviceType == apiv1.ServiceTypeLoadBalancer {
+		ports = append(ports, swarm.PortConfig{
+			PublishMode:   swarm.PortConfigPublishModeIngress,
+			PublishedPort: uint32(port.Port),
+			TargetPort:    target,
+			Protocol:      protocolFor(port.Protocol),
+		})
+	}
+	if port.NodePort != 0 {
+		ports = append(ports, swarm.PortConfig{
+			PublishMode:   swarm.PortConfigPublishModeHost,
+			PublishedPort: uint32(port.NodePort),
+			TargetPort:    target,
+			Protocol:      protocolFor(port.Protocol),
+		})
+	}
+	return ports
+}
+
+// protocolFor translates a Kubernetes Service protocol into its Swarm
+// PortConfig equivalent.
+func protocolFor(protocol apiv1.Protocol) swarm.PortConfigProtocol {
+	switch protocol {
+	case apiv1.ProtocolUDP:
+		return swarm.PortConfigProtocolUDP
+	case apiv1.ProtocolSCTP:
+		return swarm.PortConfigProtocolSCTP
+	default:
+		return swarm.PortConfigProtocolTCP
+	}
+}
+
+// targetPort resolves a ServicePort's TargetPort to a container port number.
+// TargetPort is usually already numeric, but Kubernetes also allows it to
+// name a port declared on one of the pod's containers, which must be
+// resolved against containers instead.
+func targetPort(port apiv1.ServicePort, containers []apiv1.Container) (uint32, error) {
+	if port.TargetPort.Type == intstr.Int {
+		return uint32(port.TargetPort.IntValue()), nil
+	}
+	name := port.TargetPort.StrVal
+	for _, container := range containers {
+		for _, containerPort := range container.Ports {
+			if containerPort.Name == name {
+				return uint32(containerPort.ContainerPort), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("could not resolve named target port %q", name)
+}
+
+// ingressAddr returns the address a LoadBalancer ingress is reachable at: its
+// IP if Kubernetes assigned one, or its hostname otherwise, left unresolved
+// since Swarm's VirtualIP.Addr is just a display address, not a routing
+// target.
+func ingressAddr(ingress apiv1.LoadBalancerIngress) string {
+	if ingress.IP != "" {
+		return ingress.IP
+	}
+	return ingress.Hostname
+}
+
+// isPublishedCompanion reports whether candidate is the Service
+// compose-on-kubernetes created to publish headless's ports, i.e. it belongs
+// to the same stack and is named "<headless.Name>-<suffix>".
+func isPublishedCompanion(headless, candidate *apiv1.Service) bool {
+	if candidate.Name == headless.Name {
+		return false
+	}
+	if candidate.Labels[labels.ForStackName] != headless.Labels[labels.ForStackName] {
+		return false
+	}
+	return strings.HasPrefix(candidate.Name, headless.Name+"-")
+}
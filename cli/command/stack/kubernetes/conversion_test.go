@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/docker/compose-on-kubernetes/api/labels"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	"gotest.tools/assert"
 	appsv1beta2 "k8s.io/api/apps/v1beta2"
@@ -18,7 +19,7 @@ func TestReplicasConversionNeedsAService(t *testing.T) {
 		Items: []appsv1beta2.ReplicaSet{makeReplicaSet("unknown", 0, 0)},
 	}
 	services := apiv1.ServiceList{}
-	_, err := convertToServices(&replicas, &appsv1beta2.DaemonSetList{}, &services)
+	_, err := convertToServices(&replicas, &appsv1beta2.DaemonSetList{}, &services, filters.NewArgs())
 	assert.ErrorContains(t, err, "could not find service")
 }
 
@@ -27,6 +28,7 @@ func TestKubernetesServiceToSwarmServiceConversion(t *testing.T) {
 		doc              string
 		replicas         *appsv1beta2.ReplicaSetList
 		services         *apiv1.ServiceList
+		filter           filters.Args
 		expectedServices []swarm.Service
 	}{
 		{
@@ -112,26 +114,364 @@ func TestKubernetesServiceToSwarmServiceConversion(t *testing.T) {
 				),
 			},
 		},
+		{
+			doc: "Filter by name selects only the matching service",
+			replicas: &appsv1beta2.ReplicaSetList{
+				Items: []appsv1beta2.ReplicaSet{
+					makeReplicaSet("service1", 2, 5),
+					makeReplicaSet("service2", 3, 3),
+				},
+			},
+			services: &apiv1.ServiceList{
+				Items: []apiv1.Service{
+					makeKubeService("service1", "stack", "uid1", apiv1.ServiceTypeClusterIP, nil),
+					makeKubeService("service2", "stack", "uid2", apiv1.ServiceTypeClusterIP, nil),
+				},
+			},
+			filter: filters.NewArgs(filters.Arg("name", "service1")),
+			expectedServices: []swarm.Service{
+				makeSwarmService(t, "stack_service1", "uid1", withMode("replicated", 5), withStatus(2, 5)),
+			},
+		},
+		{
+			doc: "LoadBalancer ingress IP is surfaced as a VirtualIP",
+			replicas: &appsv1beta2.ReplicaSetList{
+				Items: []appsv1beta2.ReplicaSet{
+					makeReplicaSet("service", 1, 1),
+				},
+			},
+			services: &apiv1.ServiceList{
+				Items: []apiv1.Service{
+					makeKubeService("service", "stack", "uid1", apiv1.ServiceTypeClusterIP, nil),
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: map[string]string{labels.ForStackName: "stack"},
+							Name:   "service-published",
+							UID:    apimachineryTypes.UID("uid2"),
+						},
+						Spec: apiv1.ServiceSpec{
+							Type: apiv1.ServiceTypeLoadBalancer,
+							Ports: []apiv1.ServicePort{
+								{
+									Port:       80,
+									NodePort:   32000,
+									TargetPort: apimachineryUtil.FromInt(80),
+									Protocol:   apiv1.ProtocolTCP,
+								},
+							},
+						},
+						Status: apiv1.ServiceStatus{
+							LoadBalancer: apiv1.LoadBalancerStatus{
+								Ingress: []apiv1.LoadBalancerIngress{
+									{IP: "203.0.113.10"},
+									{Hostname: "lb.example.com"},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedServices: []swarm.Service{
+				makeSwarmService(t, "stack_service", "uid1",
+					withMode("replicated", 1),
+					withStatus(1, 1),
+					withPort(swarm.PortConfig{
+						PublishMode:   swarm.PortConfigPublishModeIngress,
+						PublishedPort: 80,
+						TargetPort:    80,
+						Protocol:      swarm.PortConfigProtocolTCP,
+					}),
+					withSpecPort(swarm.PortConfig{
+						PublishMode:   swarm.PortConfigPublishModeHost,
+						PublishedPort: 32000,
+						TargetPort:    80,
+						Protocol:      swarm.PortConfigProtocolTCP,
+					}),
+					withVirtualIP("203.0.113.10"),
+					withVirtualIP("lb.example.com"),
+				),
+			},
+		},
+		{
+			doc: "Multiple ports on the same published Service each become a PortConfig",
+			replicas: &appsv1beta2.ReplicaSetList{
+				Items: []appsv1beta2.ReplicaSet{
+					makeReplicaSet("service", 1, 1),
+				},
+			},
+			services: &apiv1.ServiceList{
+				Items: []apiv1.Service{
+					makeKubeService("service", "stack", "uid1", apiv1.ServiceTypeClusterIP, nil),
+					makeKubeService("service-published", "stack", "uid2", apiv1.ServiceTypeLoadBalancer, []apiv1.ServicePort{
+						{
+							Port:       80,
+							TargetPort: apimachineryUtil.FromInt(80),
+							Protocol:   apiv1.ProtocolTCP,
+						},
+						{
+							Port:       443,
+							TargetPort: apimachineryUtil.FromInt(8443),
+							Protocol:   apiv1.ProtocolTCP,
+						},
+					}),
+				},
+			},
+			expectedServices: []swarm.Service{
+				makeSwarmService(t, "stack_service", "uid1",
+					withMode("replicated", 1),
+					withStatus(1, 1),
+					withPort(swarm.PortConfig{
+						PublishMode:   swarm.PortConfigPublishModeIngress,
+						PublishedPort: 80,
+						TargetPort:    80,
+						Protocol:      swarm.PortConfigProtocolTCP,
+					}),
+					withPort(swarm.PortConfig{
+						PublishMode:   swarm.PortConfigPublishModeIngress,
+						PublishedPort: 443,
+						TargetPort:    8443,
+						Protocol:      swarm.PortConfigProtocolTCP,
+					}),
+				),
+			},
+		},
 	}
 
 	for _, tc := range testCases {
 		tc := tc
 		t.Run(tc.doc, func(t *testing.T) {
-			swarmServices, err := convertToServices(tc.replicas, &appsv1beta2.DaemonSetList{}, tc.services)
+			swarmServices, err := convertToServices(tc.replicas, &appsv1beta2.DaemonSetList{}, tc.services, tc.filter)
 			assert.NilError(t, err)
 			assert.DeepEqual(t, tc.expectedServices, swarmServices)
 		})
 	}
 }
 
-func makeReplicaSet(service string, available, replicas int32) appsv1beta2.ReplicaSet {
-	return appsv1beta2.ReplicaSet{
+func TestDaemonSetsConversionNeedsAService(t *testing.T) {
+	daemonSets := appsv1beta2.DaemonSetList{
+		Items: []appsv1beta2.DaemonSet{makeDaemonSet("unknown", 0, 0)},
+	}
+	services := apiv1.ServiceList{}
+	_, err := convertToServices(&appsv1beta2.ReplicaSetList{}, &daemonSets, &services, filters.NewArgs())
+	assert.ErrorContains(t, err, "could not find service")
+}
+
+func TestKubernetesDaemonSetToSwarmServiceConversion(t *testing.T) {
+	testCases := []struct {
+		doc              string
+		replicas         *appsv1beta2.ReplicaSetList
+		daemonSets       *appsv1beta2.DaemonSetList
+		services         *apiv1.ServiceList
+		filter           filters.Args
+		expectedServices []swarm.Service
+	}{
+		{
+			doc:        "Headless service and LoadBalancer Service are tied to the same global Swarm service",
+			replicas:   &appsv1beta2.ReplicaSetList{},
+			daemonSets: &appsv1beta2.DaemonSetList{Items: []appsv1beta2.DaemonSet{makeDaemonSet("service", 1, 2)}},
+			services: &apiv1.ServiceList{
+				Items: []apiv1.Service{
+					makeKubeService("service", "stack", "uid1", apiv1.ServiceTypeClusterIP, nil),
+					makeKubeService("service-published", "stack", "uid2", apiv1.ServiceTypeLoadBalancer, []apiv1.ServicePort{
+						{
+							Port:       80,
+							TargetPort: apimachineryUtil.FromInt(80),
+							Protocol:   apiv1.ProtocolTCP,
+						},
+					}),
+				},
+			},
+			expectedServices: []swarm.Service{
+				makeSwarmService(t, "stack_service", "uid1",
+					withMode("global", 0),
+					withStatus(1, 2),
+					withPort(swarm.PortConfig{
+						PublishMode:   swarm.PortConfigPublishModeIngress,
+						PublishedPort: 80,
+						TargetPort:    80,
+						Protocol:      swarm.PortConfigProtocolTCP,
+					}),
+				),
+			},
+		},
+		{
+			doc:        "Headless service and NodePort Service are tied to the same global Swarm service",
+			replicas:   &appsv1beta2.ReplicaSetList{},
+			daemonSets: &appsv1beta2.DaemonSetList{Items: []appsv1beta2.DaemonSet{makeDaemonSet("service", 2, 2)}},
+			services: &apiv1.ServiceList{
+				Items: []apiv1.Service{
+					makeKubeService("service", "stack", "uid1", apiv1.ServiceTypeClusterIP, nil),
+					makeKubeService("service-random-ports", "stack", "uid2", apiv1.ServiceTypeNodePort, []apiv1.ServicePort{
+						{
+							Port:       35667,
+							TargetPort: apimachineryUtil.FromInt(80),
+							Protocol:   apiv1.ProtocolTCP,
+						},
+					}),
+				},
+			},
+			expectedServices: []swarm.Service{
+				makeSwarmService(t, "stack_service", "uid1",
+					withMode("global", 0),
+					withStatus(2, 2),
+					withPort(swarm.PortConfig{
+						PublishMode:   swarm.PortConfigPublishModeHost,
+						PublishedPort: 35667,
+						TargetPort:    80,
+						Protocol:      swarm.PortConfigProtocolTCP,
+					}),
+				),
+			},
+		},
+		{
+			doc:      "Mixed stack with a replicated service and a global service",
+			replicas: &appsv1beta2.ReplicaSetList{Items: []appsv1beta2.ReplicaSet{makeReplicaSet("web", 2, 2)}},
+			daemonSets: &appsv1beta2.DaemonSetList{
+				Items: []appsv1beta2.DaemonSet{makeDaemonSet("agent", 3, 3)},
+			},
+			services: &apiv1.ServiceList{
+				Items: []apiv1.Service{
+					makeKubeService("web", "stack", "uid1", apiv1.ServiceTypeClusterIP, nil),
+					makeKubeService("agent", "stack", "uid2", apiv1.ServiceTypeClusterIP, nil),
+				},
+			},
+			expectedServices: []swarm.Service{
+				makeSwarmService(t, "stack_web", "uid1", withMode("replicated", 2), withStatus(2, 2)),
+				makeSwarmService(t, "stack_agent", "uid2", withMode("global", 0), withStatus(3, 3)),
+			},
+		},
+		{
+			doc:      "Filter by mode=global only converts the global service, skipping the ReplicaSet entirely",
+			replicas: &appsv1beta2.ReplicaSetList{Items: []appsv1beta2.ReplicaSet{makeReplicaSet("web", 2, 2)}},
+			daemonSets: &appsv1beta2.DaemonSetList{
+				Items: []appsv1beta2.DaemonSet{makeDaemonSet("agent", 3, 3)},
+			},
+			services: &apiv1.ServiceList{
+				Items: []apiv1.Service{
+					makeKubeService("web", "stack", "uid1", apiv1.ServiceTypeClusterIP, nil),
+					makeKubeService("agent", "stack", "uid2", apiv1.ServiceTypeClusterIP, nil),
+				},
+			},
+			filter: filters.NewArgs(filters.Arg("mode", "global")),
+			expectedServices: []swarm.Service{
+				makeSwarmService(t, "stack_agent", "uid2", withMode("global", 0), withStatus(3, 3)),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.doc, func(t *testing.T) {
+			swarmServices, err := convertToServices(tc.replicas, tc.daemonSets, tc.services, tc.filter)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, tc.expectedServices, swarmServices)
+		})
+	}
+}
+
+func TestPortConversionProtocolsAndNamedTargetPorts(t *testing.T) {
+	testCases := []struct {
+		doc          string
+		containers   []apiv1.Container
+		servicePort  apiv1.ServicePort
+		expectedPort swarm.PortConfig
+	}{
+		{
+			doc: "UDP ports are translated to PortConfigProtocolUDP",
+			servicePort: apiv1.ServicePort{
+				Port:       53,
+				TargetPort: apimachineryUtil.FromInt(53),
+				Protocol:   apiv1.ProtocolUDP,
+			},
+			expectedPort: swarm.PortConfig{
+				PublishMode:   swarm.PortConfigPublishModeIngress,
+				PublishedPort: 53,
+				TargetPort:    53,
+				Protocol:      swarm.PortConfigProtocolUDP,
+			},
+		},
+		{
+			doc: "SCTP ports are translated to PortConfigProtocolSCTP",
+			servicePort: apiv1.ServicePort{
+				Port:       9999,
+				TargetPort: apimachineryUtil.FromInt(9999),
+				Protocol:   apiv1.ProtocolSCTP,
+			},
+			expectedPort: swarm.PortConfig{
+				PublishMode:   swarm.PortConfigPublishModeIngress,
+				PublishedPort: 9999,
+				TargetPort:    9999,
+				Protocol:      swarm.PortConfigProtocolSCTP,
+			},
+		},
+		{
+			doc:        "A named TargetPort is resolved against the pod template's container ports",
+			containers: []apiv1.Container{{Image: "image", Ports: []apiv1.ContainerPort{{Name: "http", ContainerPort: 8080}}}},
+			servicePort: apiv1.ServicePort{
+				Port:       80,
+				TargetPort: apimachineryUtil.FromString("http"),
+				Protocol:   apiv1.ProtocolTCP,
+			},
+			expectedPort: swarm.PortConfig{
+				PublishMode:   swarm.PortConfigPublishModeIngress,
+				PublishedPort: 80,
+				TargetPort:    8080,
+				Protocol:      swarm.PortConfigProtocolTCP,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.doc, func(t *testing.T) {
+			containers := tc.containers
+			if containers == nil {
+				containers = []apiv1.Container{{Image: "image"}}
+			}
+			replicas := &appsv1beta2.ReplicaSetList{
+				Items: []appsv1beta2.ReplicaSet{makeReplicaSetWithContainers("service", 1, 1, containers)},
+			}
+			services := &apiv1.ServiceList{
+				Items: []apiv1.Service{
+					makeKubeService("service", "stack", "uid1", apiv1.ServiceTypeClusterIP, nil),
+					makeKubeService("service-published", "stack", "uid2", apiv1.ServiceTypeLoadBalancer, []apiv1.ServicePort{tc.servicePort}),
+				},
+			}
+			swarmServices, err := convertToServices(replicas, &appsv1beta2.DaemonSetList{}, services, filters.NewArgs())
+			assert.NilError(t, err)
+			assert.DeepEqual(t, []swarm.PortConfig{tc.expectedPort}, swarmServices[0].Endpoint.Ports)
+		})
+	}
+}
+
+func TestPortConversionUnresolvedNamedTargetPort(t *testing.T) {
+	replicas := &appsv1beta2.ReplicaSetList{
+		Items: []appsv1beta2.ReplicaSet{makeReplicaSet("service", 1, 1)},
+	}
+	services := &apiv1.ServiceList{
+		Items: []apiv1.Service{
+			makeKubeService("service", "stack", "uid1", apiv1.ServiceTypeClusterIP, nil),
+			makeKubeService("service-published", "stack", "uid2", apiv1.ServiceTypeLoadBalancer, []apiv1.ServicePort{
+				{
+					Port:       80,
+					TargetPort: apimachineryUtil.FromString("missing"),
+					Protocol:   apiv1.ProtocolTCP,
+				},
+			}),
+		},
+	}
+	_, err := convertToServices(replicas, &appsv1beta2.DaemonSetList{}, services, filters.NewArgs())
+	assert.ErrorContains(t, err, `could not resolve named target port "missing"`)
+}
+
+func makeDaemonSet(service string, available, desired int32) appsv1beta2.DaemonSet {
+	return appsv1beta2.DaemonSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Labels: map[string]string{
 				labels.ForServiceName: service,
 			},
 		},
-		Spec: appsv1beta2.ReplicaSetSpec{
+		Spec: appsv1beta2.DaemonSetSpec{
 			Template: apiv1.PodTemplateSpec{
 				Spec: apiv1.PodSpec{
 					Containers: []apiv1.Container{
@@ -142,6 +482,31 @@ func makeReplicaSet(service string, available, replicas int32) appsv1beta2.Repli
 				},
 			},
 		},
+		Status: appsv1beta2.DaemonSetStatus{
+			NumberAvailable:        available,
+			DesiredNumberScheduled: desired,
+		},
+	}
+}
+
+func makeReplicaSet(service string, available, replicas int32) appsv1beta2.ReplicaSet {
+	return makeReplicaSetWithContainers(service, available, replicas, []apiv1.Container{{Image: "image"}})
+}
+
+func makeReplicaSetWithContainers(service string, available, replicas int32, containers []apiv1.Container) appsv1beta2.ReplicaSet {
+	return appsv1beta2.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				labels.ForServiceName: service,
+			},
+		},
+		Spec: appsv1beta2.ReplicaSetSpec{
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: containers,
+				},
+			},
+		},
 		Status: appsv1beta2.ReplicaSetStatus{
 			AvailableReplicas: available,
 			Replicas:          replicas,
@@ -190,6 +555,21 @@ func withPort(port swarm.PortConfig) func(*swarm.Service) {
 			service.Endpoint.Ports = make([]swarm.PortConfig, 0)
 		}
 		service.Endpoint.Ports = append(service.Endpoint.Ports, port)
+		if port.PublishMode == swarm.PortConfigPublishModeIngress {
+			service.Endpoint.Spec.Ports = append(service.Endpoint.Spec.Ports, port)
+		}
+	}
+}
+
+func withVirtualIP(addr string) func(*swarm.Service) {
+	return func(service *swarm.Service) {
+		service.Endpoint.VirtualIPs = append(service.Endpoint.VirtualIPs, swarm.EndpointVirtualIP{Addr: addr})
+	}
+}
+
+func withSpecPort(port swarm.PortConfig) func(*swarm.Service) {
+	return func(service *swarm.Service) {
+		service.Endpoint.Spec.Ports = append(service.Endpoint.Spec.Ports, port)
 	}
 }
 